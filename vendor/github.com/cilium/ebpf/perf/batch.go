@@ -0,0 +1,144 @@
+package perf
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/cilium/ebpf/internal"
+	"github.com/cilium/ebpf/internal/unix"
+
+	"github.com/pkg/errors"
+)
+
+// ReadBatch drains every epoll-ready ring in one call, writing into the
+// caller-supplied dst slots instead of allocating a fresh Record (and a
+// fresh RawSample) per event.
+//
+// It returns the number of records written into dst, blocking until at
+// least one is available. Once something has been read, ReadBatch stops
+// as soon as no more rings are immediately ready rather than waiting for
+// dst to fill, so a batch that drains everything currently queued comes
+// back to the caller right away instead of blocking for more. Rings that
+// are still readable once dst fills up are left queued and drained on a
+// subsequent call, so no data is lost between calls. Reuse dst's
+// elements (for example via a sync.Pool) and call Record.Reset between
+// uses to keep their RawSample backing arrays alive across calls.
+func (pr *Reader) ReadBatch(dst []Record) (n int, err error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.epollFd == -1 {
+		return 0, errClosed
+	}
+
+	for n < len(dst) {
+		if len(pr.epollRings) == 0 {
+			// Block for the first record; once we have at least one,
+			// only poll for more that are already queued, so a batch
+			// is returned as soon as it goes dry instead of waiting
+			// for dst to fill completely.
+			timeout := -1
+			if n > 0 {
+				timeout = 0
+			}
+
+			nEvents, err := unix.EpollWait(pr.epollFd, pr.epollEvents, timeout)
+			if temp, ok := err.(temporaryError); ok && temp.Temporary() {
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+
+			if nEvents == 0 {
+				// Non-blocking poll found nothing left ready.
+				return n, nil
+			}
+
+			for _, event := range pr.epollEvents[:nEvents] {
+				if int(event.Fd) == pr.closeFd {
+					if n > 0 {
+						return n, nil
+					}
+					return 0, errClosed
+				}
+
+				ring := pr.rings[cpuForEvent(&event)]
+				pr.epollRings = append(pr.epollRings, ring)
+				ring.loadHead()
+			}
+		}
+
+		for n < len(dst) && len(pr.epollRings) > 0 {
+			ring := pr.epollRings[len(pr.epollRings)-1]
+			if err := readRecordFromRingInto(ring, &dst[n]); err != nil {
+				if err == errEOR {
+					pr.epollRings = pr.epollRings[:len(pr.epollRings)-1]
+					continue
+				}
+				return n, err
+			}
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// NB: Has to be preceded by a call to ring.loadHead.
+func readRecordFromRingInto(ring *perfEventRing, rec *Record) error {
+	defer ring.writeTail()
+	return readRecordInto(ring, ring.cpu, rec)
+}
+
+func readRecordInto(rd io.Reader, cpu int, rec *Record) error {
+	var header perfEventHeader
+	err := binary.Read(rd, internal.NativeEndian, &header)
+	if err == io.EOF {
+		return errEOR
+	}
+	if err != nil {
+		return errors.Wrap(err, "can't read event header")
+	}
+
+	rec.CPU = cpu
+	switch header.Type {
+	case perfRecordLost:
+		rec.RawSample = rec.RawSample[:0]
+		rec.RequestRead = nil
+		rec.LostSamples, err = readLostRecords(rd)
+		return err
+
+	case perfRecordSample:
+		rec.LostSamples = 0
+		if err := readRawSampleInto(rd, rec); err != nil {
+			return err
+		}
+		if rr, ok := parseRequestRead(rec.RawSample); ok {
+			rec.RawSample = rec.RawSample[:0]
+			rec.RequestRead = &rr
+		} else {
+			rec.RequestRead = nil
+		}
+		return nil
+
+	default:
+		return &unknownEventError{header.Type}
+	}
+}
+
+func readRawSampleInto(rd io.Reader, rec *Record) error {
+	var size uint32
+	if err := binary.Read(rd, internal.NativeEndian, &size); err != nil {
+		return errors.Wrap(err, "can't read sample size")
+	}
+
+	if cap(rec.RawSample) < int(size) {
+		rec.RawSample = make([]byte, size)
+	} else {
+		rec.RawSample = rec.RawSample[:size]
+	}
+
+	_, err := io.ReadFull(rd, rec.RawSample)
+	return errors.Wrap(err, "can't read sample")
+}
@@ -0,0 +1,270 @@
+package perf
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf/internal/unix"
+
+	"github.com/pkg/errors"
+)
+
+// netpollRing pairs a perf ring with an *os.File wrapping a dup of its fd,
+// so blocking reads on it are serviced by the Go runtime's netpoller
+// instead of our own epoll loop.
+type netpollRing struct {
+	ring *perfEventRing
+	file *os.File
+}
+
+// netpollFiles lazily dups and registers every ring's fd with the
+// runtime netpoller, caching the result on the Reader. It returns an
+// error if any fd can't be put into non-blocking mode, in which case the
+// caller should fall back to the epoll-based Read.
+func (pr *Reader) netpollFiles() ([]netpollRing, error) {
+	if pr.netpollRings != nil {
+		return pr.netpollRings, nil
+	}
+
+	rings := make([]netpollRing, 0, len(pr.rings))
+	ok := false
+	defer func() {
+		if !ok {
+			for _, nr := range rings {
+				nr.file.Close()
+			}
+		}
+	}()
+
+	for _, ring := range pr.rings {
+		fd, err := unix.Dup(ring.fd)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't dup ring fd")
+		}
+
+		if err := unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fd)
+			return nil, errors.Wrap(err, "can't set ring fd non-blocking")
+		}
+
+		rings = append(rings, netpollRing{ring: ring, file: os.NewFile(uintptr(fd), "perf-ring")})
+	}
+
+	ok = true
+	pr.netpollRings = rings
+	return rings, nil
+}
+
+// ReadCtx behaves like Read, but returns early with ctx.Err() wrapped when
+// ctx is cancelled, instead of requiring the caller to tear down the
+// Reader via Close just to unblock a goroutine. Unlike Read, it does not
+// read from the overflow buffer of an Overflow: Drop Reader; it always
+// reads the rings directly.
+//
+// Internally, each ring's fd is duped into non-blocking mode and
+// registered with the Go runtime via os.NewFile(fd, ...).SyscallConn(), so
+// a blocked ReadCtx is woken by the scheduler's netpoller -- the same
+// approach fsnotify took when it dropped its hand-rolled inotify_poller.
+// ReadCtx falls back to the epoll path used by Read if the rings can't be
+// registered with the netpoller, for example because the kernel disallows
+// non-blocking perf ring fds.
+func (pr *Reader) ReadCtx(ctx context.Context) (Record, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.epollFd == -1 {
+		return Record{}, errClosed
+	}
+
+	if record, err := pr.readAvailable(); err != errEOR {
+		return record, err
+	}
+
+	rings, err := pr.netpollFiles()
+	if err != nil {
+		return pr.readLockedCtx(ctx)
+	}
+
+	// A previous ReadCtx call that returned via ctx cancellation or Close
+	// leaves a past deadline on these cached files, to interrupt its own
+	// goroutines below. Clear it before reusing them here, or every future
+	// call would see ErrDeadlineExceeded immediately and could never wait
+	// for data again.
+	for _, nr := range rings {
+		nr.file.SetReadDeadline(time.Time{})
+	}
+
+	// readyRings is fed by one goroutine per ring, each parked in the
+	// netpoller until its fd becomes readable. It's sized so that no
+	// goroutine ever blocks trying to report in.
+	readyRings := make(chan *perfEventRing, len(rings))
+
+	// This call owns the goroutines it spawns below outright: the deferred
+	// cleanup nudges their deadline and waits for every one of them to
+	// actually exit before ReadCtx returns and releases pr.mu. Without
+	// that, goroutines from one call would outlive it, and an overlapping
+	// call would spawn a second goroutine racing the first over the same
+	// ring.
+	var wg sync.WaitGroup
+	defer func() {
+		for _, nr := range rings {
+			nr.file.SetReadDeadline(time.Unix(0, 1))
+		}
+		wg.Wait()
+	}()
+
+	for i := range rings {
+		nr := rings[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := nr.file.SyscallConn()
+			if err != nil {
+				return
+			}
+
+			// f must perform the real non-blocking operation and report
+			// back whether it actually succeeded; returning true
+			// unconditionally (without checking for EAGAIN) would stop
+			// the netpoller from ever parking this goroutine, so it'd
+			// fire immediately on an empty ring instead of waiting for
+			// data. A raw read on the ring's fd is enough to learn that:
+			// the fd turns readable exactly when the perf ring has a new
+			// sample queued, regardless of what the read itself returns.
+			var probe [8]byte
+			err = conn.Read(func(fd uintptr) bool {
+				_, err := unix.Read(int(fd), probe[:])
+				return err != unix.EAGAIN
+			})
+			if err != nil {
+				return
+			}
+
+			readyRings <- nr.ring
+		}()
+	}
+
+	select {
+	case ring := <-readyRings:
+		// loadHead runs here, under pr.mu, instead of in the goroutine
+		// above: that goroutine only learns its ring is readable, it
+		// never touches ring state, so two goroutines racing the same
+		// ring can no longer race its head/tail bookkeeping too.
+		ring.loadHead()
+		pr.epollRings = append(pr.epollRings, ring)
+		return pr.readAvailable()
+
+	case <-ctx.Done():
+		return Record{}, errors.Wrap(ctx.Err(), "perf reader")
+
+	case <-pr.closing:
+		return Record{}, errClosed
+	}
+}
+
+// SetDeadline sets a deadline for future ReadCtx calls, analogous to
+// net.Conn.SetDeadline. A zero value disables the deadline.
+func (pr *Reader) SetDeadline(t time.Time) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	rings, err := pr.netpollFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, nr := range rings {
+		if err := nr.file.SetReadDeadline(t); err != nil {
+			return errors.Wrap(err, "can't set ring deadline")
+		}
+	}
+
+	return nil
+}
+
+// readLocked is the original epoll-based Read loop, factored out so
+// ReadCtx can fall back to it. pr.mu must already be held.
+func (pr *Reader) readLocked() (Record, error) {
+	for {
+		record, err := pr.readAvailable()
+		if err != errEOR {
+			return record, err
+		}
+
+		nEvents, err := unix.EpollWait(pr.epollFd, pr.epollEvents, -1)
+		if temp, ok := err.(temporaryError); ok && temp.Temporary() {
+			continue
+		}
+
+		if err != nil {
+			return Record{}, err
+		}
+
+		for _, event := range pr.epollEvents[:nEvents] {
+			if int(event.Fd) == pr.closeFd {
+				return Record{}, errClosed
+			}
+
+			ring := pr.rings[cpuForEvent(&event)]
+			pr.epollRings = append(pr.epollRings, ring)
+			ring.loadHead()
+		}
+	}
+}
+
+// readLockedCtx is readLocked, but polled against a short timeout so it
+// notices ctx cancellation instead of blocking in EpollWait(-1) forever.
+// Used as ReadCtx's fallback when the netpoller can't be used; pr.mu must
+// already be held.
+func (pr *Reader) readLockedCtx(ctx context.Context) (Record, error) {
+	const ctxPollInterval = 100 // milliseconds
+
+	for {
+		record, err := pr.readAvailable()
+		if err != errEOR {
+			return record, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return Record{}, errors.Wrap(err, "perf reader")
+		}
+
+		nEvents, err := unix.EpollWait(pr.epollFd, pr.epollEvents, ctxPollInterval)
+		if temp, ok := err.(temporaryError); ok && temp.Temporary() {
+			continue
+		}
+
+		if err != nil {
+			return Record{}, err
+		}
+
+		for _, event := range pr.epollEvents[:nEvents] {
+			if int(event.Fd) == pr.closeFd {
+				return Record{}, errClosed
+			}
+
+			ring := pr.rings[cpuForEvent(&event)]
+			pr.epollRings = append(pr.epollRings, ring)
+			ring.loadHead()
+		}
+	}
+}
+
+// readAvailable drains whatever is already loaded in pr.epollRings,
+// returning errEOR once none of them have anything left.
+func (pr *Reader) readAvailable() (Record, error) {
+	if len(pr.epollRings) == 0 {
+		return Record{}, errEOR
+	}
+
+	record, err := readRecordFromRing(pr.epollRings[len(pr.epollRings)-1])
+	if err == errEOR {
+		pr.epollRings = pr.epollRings[:len(pr.epollRings)-1]
+		return pr.readAvailable()
+	}
+
+	return record, err
+}
@@ -0,0 +1,284 @@
+package perf
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/internal"
+	"github.com/cilium/ebpf/internal/unix"
+
+	"github.com/pkg/errors"
+)
+
+// pollerEntry is keyed by a ring's fd, which is exactly what epoll hands
+// back to us, so Add/Remove never need to renumber anything.
+type pollerEntry struct {
+	ring *perfEventRing
+	fn   func(Record) error
+}
+
+// pollerArray tracks the rings and the cloned map backing one Add call, so
+// Remove can tear them down again.
+type pollerArray struct {
+	array *ebpf.Map
+	rings []*perfEventRing
+}
+
+// Poller multiplexes several perf event arrays onto a single epoll fd and
+// dispatches each record to a per-map callback from one goroutine, the way
+// libbpf's ring_buffer__add/ring_buffer__poll multiplex several ring
+// buffers.
+//
+// A plain Reader needs one goroutine per map, which scales poorly for
+// agents that attach a small perf event array per probe. Poller lets all
+// of them share a single epoll fd and a single calling goroutine instead.
+type Poller struct {
+	mu sync.Mutex
+
+	epollFd     int
+	epollEvents []unix.EpollEvent
+
+	entries map[int]*pollerEntry
+	arrays  map[*ebpf.Map]*pollerArray
+
+	closeFd   int
+	closeOnce sync.Once
+}
+
+// NewPoller creates an empty Poller. Use Add to attach perf event arrays
+// to it.
+func NewPoller() (pp *Poller, err error) {
+	epollFd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create epoll fd")
+	}
+
+	fds := []int{epollFd}
+	defer func() {
+		if err != nil {
+			for _, fd := range fds {
+				unix.Close(fd)
+			}
+		}
+	}()
+
+	closeFd, err := unix.Eventfd(0, unix.O_CLOEXEC|unix.O_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	fds = append(fds, closeFd)
+
+	if err := addToEpoll(epollFd, closeFd, -1); err != nil {
+		return nil, err
+	}
+
+	pp = &Poller{
+		epollFd:     epollFd,
+		epollEvents: make([]unix.EpollEvent, 1),
+		entries:     make(map[int]*pollerEntry),
+		arrays:      make(map[*ebpf.Map]*pollerArray),
+		closeFd:     closeFd,
+	}
+	runtime.SetFinalizer(pp, (*Poller).Close)
+	return pp, nil
+}
+
+// Add attaches array to the Poller, creating one perf ring per CPU exactly
+// like NewReaderWithOptions, and arranges for every record read from them
+// to be passed to fn.
+//
+// fn is called from whichever goroutine is executing Poll; it must not
+// block for long, since it holds up every other map attached to this
+// Poller.
+func (pp *Poller) Add(array *ebpf.Map, perCPUBuffer int, fn func(Record) error) (err error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.epollFd == -1 {
+		return errClosed
+	}
+	if _, exists := pp.arrays[array]; exists {
+		return errors.New("map is already attached to this Poller")
+	}
+
+	clone, err := array.Clone()
+	if err != nil {
+		return err
+	}
+
+	nCPU := int(clone.ABI().MaxEntries)
+	rings := make([]*perfEventRing, 0, nCPU)
+	defer func() {
+		if err != nil {
+			for _, ring := range rings {
+				delete(pp.entries, ring.fd)
+				unix.EpollCtl(pp.epollFd, unix.EPOLL_CTL_DEL, ring.fd, nil)
+				ring.Close()
+			}
+			clone.Close()
+		}
+	}()
+
+	for i := 0; i < nCPU; i++ {
+		var ring *perfEventRing
+		ring, err = newPerfEventRing(i, perCPUBuffer, 0)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create perf ring for CPU %d", i)
+			return err
+		}
+		rings = append(rings, ring)
+
+		if err = addToEpoll(pp.epollFd, ring.fd, i); err != nil {
+			return err
+		}
+		pp.entries[ring.fd] = &pollerEntry{ring: ring, fn: fn}
+
+		// bpf_perf_event_output reads the fd to signal out of the map
+		// slot for this CPU; without this the kernel has nowhere to
+		// send samples and every callback above is unreachable.
+		if err = clone.Put(uint32(i), uint32(ring.fd)); err != nil {
+			err = errors.Wrapf(err, "could't put event fd %d for CPU %d", ring.fd, i)
+			return err
+		}
+	}
+
+	pp.epollEvents = make([]unix.EpollEvent, len(pp.entries)+1)
+	pp.arrays[array] = &pollerArray{array: clone, rings: rings}
+	return nil
+}
+
+// Remove detaches array from the Poller and closes its rings. It is a
+// no-op if array isn't attached.
+func (pp *Poller) Remove(array *ebpf.Map) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.epollFd == -1 {
+		return errClosed
+	}
+
+	pa, ok := pp.arrays[array]
+	if !ok {
+		return nil
+	}
+
+	for _, ring := range pa.rings {
+		if err := unix.EpollCtl(pp.epollFd, unix.EPOLL_CTL_DEL, ring.fd, nil); err != nil {
+			return errors.Wrap(err, "can't remove ring fd from epoll")
+		}
+		delete(pp.entries, ring.fd)
+		ring.Close()
+	}
+	pa.array.Close()
+	delete(pp.arrays, array)
+	return nil
+}
+
+// Poll dispatches records from every attached map to their callback until
+// ctx is cancelled, a callback returns an error, or Close is called.
+//
+// ctx is polled for cancellation on a short epoll timeout rather than via
+// a dedicated wakeup fd, so cancellation may lag by up to that timeout.
+func (pp *Poller) Poll(ctx context.Context) error {
+	const ctxPollInterval = 100 // milliseconds
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		pp.mu.Lock()
+		if pp.epollFd == -1 {
+			pp.mu.Unlock()
+			return errClosed
+		}
+		epollFd, events := pp.epollFd, pp.epollEvents
+		pp.mu.Unlock()
+
+		nEvents, err := unix.EpollWait(epollFd, events, ctxPollInterval)
+		if temp, ok := err.(temporaryError); ok && temp.Temporary() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events[:nEvents] {
+			if int(event.Fd) == pp.closeFd {
+				return errClosed
+			}
+
+			if err := pp.dispatch(int(event.Fd)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dispatch reads every record currently queued on the ring identified by
+// fd and passes them to its callback.
+//
+// pp.mu is held for the full ring read and callback, not just the
+// pp.entries lookup: Remove munmaps a ring as soon as it has pp.mu, so
+// reading it without holding the same lock would race a concurrent
+// Remove and could read through unmapped memory.
+func (pp *Poller) dispatch(fd int) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	entry, ok := pp.entries[fd]
+	if !ok {
+		// Removed between EpollWait returning and us looking it up.
+		return nil
+	}
+
+	entry.ring.loadHead()
+	for {
+		record, err := readRecordFromRing(entry.ring)
+		if err == errEOR {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := entry.fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// Close frees all resources used by the Poller, detaching every attached
+// map and interrupting Poll.
+func (pp *Poller) Close() error {
+	var err error
+	pp.closeOnce.Do(func() {
+		runtime.SetFinalizer(pp, nil)
+
+		var value [8]byte
+		internal.NativeEndian.PutUint64(value[:], 1)
+		if _, err = unix.Write(pp.closeFd, value[:]); err != nil {
+			err = errors.Wrap(err, "can't write event fd")
+			return
+		}
+
+		pp.mu.Lock()
+		defer pp.mu.Unlock()
+
+		unix.Close(pp.epollFd)
+		unix.Close(pp.closeFd)
+		pp.epollFd, pp.closeFd = -1, -1
+
+		for _, pa := range pp.arrays {
+			for _, ring := range pa.rings {
+				ring.Close()
+			}
+			pa.array.Close()
+		}
+		pp.entries = nil
+		pp.arrays = nil
+	})
+
+	return errors.Wrap(err, "close Poller")
+}
@@ -0,0 +1,192 @@
+package perf
+
+import "sync/atomic"
+
+// OverflowMode selects what a Reader does when its consumer falls behind
+// a fast producer.
+type OverflowMode int
+
+const (
+	// Block is the default: the reader backpressures the kernel ring via
+	// Watermark, same as always. No samples are ever silently dropped.
+	Block OverflowMode = iota
+
+	// Drop copies samples into a lock-free profBuf as they arrive and
+	// lets the producer continue even if the consumer can't keep up,
+	// dropping the incoming sample once the buffer fills instead of
+	// backpressuring the kernel ring. The number of dropped samples
+	// surfaces as Record.LostSamples, the same field perfRecordLost
+	// normally populates.
+	Drop
+)
+
+// profBuf is a lock-free single-producer/single-consumer ring used by
+// Overflow: Drop readers, modelled on the Go runtime's internal CPU
+// profile buffer (runtime/profbuf.go): a fixed, power-of-two-sized byte
+// array holds sample payloads, while a parallel, independently indexed
+// tag array holds each entry's framing (which CPU it came from, and how
+// long it is) so the consumer never needs to parse an in-band header.
+//
+// Memory ordering: the producer reserves space against a private counter
+// (writeTail, touched only by it), writes the tag and copies the payload,
+// and only then release-stores the public tail -- the one field readers
+// actually load. Reads of tail therefore use acquire semantics and are
+// guaranteed to see a fully-written entry, never a reservation in
+// progress. The consumer stores head with release semantics after it
+// finishes copying out an entry, which is what the producer's capacity
+// check (an acquire load of head) pairs with. 64-bit atomics are native
+// on every architecture this package targets, so both sides are
+// lock-free.
+type profBuf struct {
+	data []byte
+	tags []profTag
+
+	dataMask uint64
+	tagMask  uint64
+
+	// entrySeq and writeTail are only ever touched by the producer: there
+	// is exactly one writer, so neither needs to be atomic. entrySeq
+	// numbers each reservation so the tag for sample N always lands in
+	// tags[N&tagMask], independent of that sample's variable-length
+	// position in data. writeTail is the producer's reservation cursor,
+	// used for the capacity check; it must never be read by the consumer
+	// directly, only via the published 'tail' below.
+	entrySeq  uint64
+	writeTail uint64
+
+	// tail/head each pack a monotonically increasing overflow count into
+	// the high 32 bits and a byte position into the low 32 bits. tail is
+	// only published by the producer once an entry is fully written;
+	// head is only ever written by the consumer.
+	tail uint64
+	head uint64
+
+	// readSeq is only ever written by the (single) consumer: entries are
+	// always drained in the order they were written, so the consumer can
+	// track which tags slot comes next itself instead of recomputing it
+	// from byte positions.
+	readSeq uint64
+}
+
+type profTag struct {
+	cpu    int
+	length uint32
+}
+
+func newProfBuf(size int) *profBuf {
+	size = int(nextPowerOfTwo(uint64(size)))
+	// Every live entry occupies at least 1 byte of data, so in the worst
+	// case (all 1-byte samples) there can be as many outstanding entries
+	// as there are data bytes. Size the tag ring for that worst case, or
+	// a fast producer could wrap it around and overwrite the framing for
+	// an entry the consumer hasn't read yet.
+	tagCount := nextPowerOfTwo(uint64(size))
+
+	return &profBuf{
+		data:     make([]byte, size),
+		tags:     make([]profTag, tagCount),
+		dataMask: uint64(size) - 1,
+		tagMask:  tagCount - 1,
+	}
+}
+
+func nextPowerOfTwo(n uint64) uint64 {
+	p := uint64(1)
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+func splitPos(pos uint64) (overflow uint32, offset uint32) {
+	return uint32(pos >> 32), uint32(pos)
+}
+
+func joinPos(overflow, offset uint32) uint64 {
+	return uint64(overflow)<<32 | uint64(offset)
+}
+
+// Write reserves space for sample and copies it in. It returns false if
+// doing so would overtake the reader, bumping the overflow counter
+// instead of blocking; the caller should treat that as a dropped sample.
+//
+// Write must only ever be called from a single goroutine: it reserves
+// space against the private writeTail counter and only publishes the
+// entry -- tag, payload and all -- by release-storing the public tail
+// once it's complete, so a concurrent Read can never observe a partially
+// written entry.
+func (b *profBuf) Write(cpu int, sample []byte) bool {
+	head := atomic.LoadUint64(&b.head) // acquire: see the reader's latest progress
+
+	tailOverflow, tailOff := splitPos(b.writeTail)
+	_, headOff := splitPos(head)
+
+	used := uint64(tailOff - headOff)
+	if used+uint64(len(sample)) > b.dataMask+1 {
+		b.writeTail = joinPos(tailOverflow+1, tailOff)
+		atomic.StoreUint64(&b.tail, b.writeTail) // release: publish the overflow count
+		return false
+	}
+
+	seq := b.entrySeq
+	b.entrySeq++
+	b.tags[seq&b.tagMask] = profTag{cpu: cpu, length: uint32(len(sample))}
+	b.copyIn(uint64(tailOff), sample)
+
+	b.writeTail = joinPos(tailOverflow, tailOff+uint32(len(sample)))
+	atomic.StoreUint64(&b.tail, b.writeTail) // release: only now is this entry visible
+	return true
+}
+
+func (b *profBuf) copyIn(off uint64, sample []byte) {
+	start := off & b.dataMask
+	n := copy(b.data[start:], sample)
+	if n < len(sample) {
+		copy(b.data, sample[n:])
+	}
+}
+
+func (b *profBuf) copyOut(off uint64, n uint32) []byte {
+	start := off & b.dataMask
+	out := make([]byte, n)
+	copied := copy(out, b.data[start:])
+	if uint32(copied) < n {
+		copy(out[copied:], b.data)
+	}
+	return out
+}
+
+// Read returns the next record, with LostSamples set to the number of
+// samples dropped since the previous record was read (whether they were
+// dropped before or after this record was written), or ok == false if
+// nothing is available yet.
+func (b *profBuf) Read() (record Record, ok bool) {
+	head := atomic.LoadUint64(&b.head)
+	tail := atomic.LoadUint64(&b.tail) // acquire: pairs with the writer's release store of tail
+
+	headOverflow, headOff := splitPos(head)
+	tailOverflow, tailOff := splitPos(tail)
+
+	// Position equality alone means there's no unread entry, even if
+	// overflow has advanced: Write publishes an overflow-only bump (tail's
+	// offset left unchanged) when it drops a sample, including when the
+	// ring is already empty and the incoming sample alone exceeds its
+	// capacity. Requiring the overflow counts to match too would treat
+	// that bump as a real entry and hand out a phantom tag/length. Leaving
+	// head untouched here keeps the overflow delta around to attach to
+	// whatever real entry eventually does land.
+	if headOff == tailOff {
+		return Record{}, false
+	}
+
+	lost := uint64(tailOverflow - headOverflow)
+
+	tag := b.tags[b.readSeq&b.tagMask]
+	b.readSeq++
+
+	sample := b.copyOut(uint64(headOff), tag.length)
+	newHead := joinPos(tailOverflow, headOff+tag.length)
+	atomic.StoreUint64(&b.head, newHead) // release: frees this space for the writer
+
+	return Record{CPU: tag.cpu, RawSample: sample, LostSamples: lost}, true
+}
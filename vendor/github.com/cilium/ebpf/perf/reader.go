@@ -1,6 +1,7 @@
 package perf
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -20,6 +21,47 @@ var (
 	errEOR    = errors.New("end of ring")
 )
 
+// overflowLostMagic prefixes a profBuf entry that stands in for a kernel
+// PERF_RECORD_LOST count rather than sample data, the same way
+// requestReadMagic marks a fault-in request: a lost count has no raw
+// sample bytes of its own, but profBuf only ever moves bytes, so
+// driveOverflow encodes one as a tiny synthetic payload and readOverflow
+// decodes it back into Record.LostSamples on the way out.
+const overflowLostMagic uint64 = 0x4c4f_5354_5f63_6e74 // "LOST_cnt"
+
+type overflowLostWire struct {
+	Magic uint64
+	Lost  uint64
+}
+
+const overflowLostWireSize = 16
+
+func encodeOverflowLost(lost uint64) []byte {
+	wire := overflowLostWire{Magic: overflowLostMagic, Lost: lost}
+
+	buf := new(bytes.Buffer)
+	buf.Grow(overflowLostWireSize)
+	// binary.Write into a bytes.Buffer never errors.
+	_ = binary.Write(buf, internal.NativeEndian, &wire)
+	return buf.Bytes()
+}
+
+func parseOverflowLost(sample []byte) (uint64, bool) {
+	if len(sample) != overflowLostWireSize {
+		return 0, false
+	}
+
+	var wire overflowLostWire
+	if err := binary.Read(bytes.NewReader(sample), internal.NativeEndian, &wire); err != nil {
+		return 0, false
+	}
+	if wire.Magic != overflowLostMagic {
+		return 0, false
+	}
+
+	return wire.Lost, true
+}
+
 // perfEventHeader must match 'struct perf_event_header` in <linux/perf_event.h>.
 type perfEventHeader struct {
 	Type uint32
@@ -65,8 +107,27 @@ type Record struct {
 	// The number of samples which could not be output, since
 	// the ring buffer was full.
 	LostSamples uint64
+
+	// RequestRead is set instead of RawSample when the sample is a
+	// "please fault this in" request recognised by parseRequestRead; see
+	// ServiceRequestRead.
+	RequestRead *RequestReadRecord
+}
+
+// Reset clears a Record so its RawSample backing array can be reused by
+// ReadBatch, without releasing the underlying allocation.
+func (r *Record) Reset() {
+	r.CPU = 0
+	r.RawSample = r.RawSample[:0]
+	r.LostSamples = 0
+	r.RequestRead = nil
 }
 
+const (
+	perfRecordLost   = 2
+	perfRecordSample = 9
+)
+
 // NB: Has to be preceded by a call to ring.loadHead.
 func readRecordFromRing(ring *perfEventRing) (Record, error) {
 	defer ring.writeTail()
@@ -74,11 +135,6 @@ func readRecordFromRing(ring *perfEventRing) (Record, error) {
 }
 
 func readRecord(rd io.Reader, cpu int) (Record, error) {
-	const (
-		perfRecordLost   = 2
-		perfRecordSample = 9
-	)
-
 	var header perfEventHeader
 	err := binary.Read(rd, internal.NativeEndian, &header)
 	if err == io.EOF {
@@ -96,7 +152,13 @@ func readRecord(rd io.Reader, cpu int) (Record, error) {
 
 	case perfRecordSample:
 		sample, err := readRawSample(rd)
-		return Record{CPU: cpu, RawSample: sample}, err
+		if err != nil {
+			return Record{}, err
+		}
+		if rr, ok := parseRequestRead(sample); ok {
+			return Record{CPU: cpu, RequestRead: &rr}, nil
+		}
+		return Record{CPU: cpu, RawSample: sample}, nil
 
 	default:
 		return Record{}, &unknownEventError{header.Type}
@@ -156,6 +218,24 @@ type Reader struct {
 	// Read calls, which would otherwise need to be interrupted.
 	pauseMu  sync.Mutex
 	pauseFds []int
+
+	// netpollRings lazily mirrors 'rings' as non-blocking *os.Files
+	// registered with the Go runtime netpoller, used by ReadCtx and
+	// SetDeadline. Populated on first use, protected by 'mu'.
+	netpollRings []netpollRing
+
+	// closing is closed by Close, before it tries to acquire 'mu', so
+	// that a ReadCtx call parked in its netpoll select (which holds 'mu'
+	// for as long as it blocks) wakes up and releases the lock instead
+	// of deadlocking against Close forever.
+	closing chan struct{}
+
+	// overflow is non-nil when ReaderOptions.Overflow is Drop. A
+	// background goroutine drains the epoll-backed rings into it as fast
+	// as the kernel produces data, and Read reads from it instead of the
+	// rings directly. ReadCtx and ReadBatch do not use it: they read the
+	// rings directly, alongside the background goroutine.
+	overflow *profBuf
 }
 
 // ReaderOptions control the behaviour of the user
@@ -165,6 +245,11 @@ type ReaderOptions struct {
 	// Read will process data. Must be smaller than PerCPUBuffer.
 	// The default is to start processing as soon as data is available.
 	Watermark int
+
+	// Overflow controls what happens once a consumer falls behind a fast
+	// producer. The default, Block, backpressures the kernel ring the
+	// way Watermark always has. See OverflowMode for the Drop alternative.
+	Overflow OverflowMode
 }
 
 // NewReader creates a new reader with default options.
@@ -245,6 +330,7 @@ func NewReaderWithOptions(array *ebpf.Map, perCPUBuffer int, opts ReaderOptions)
 		epollRings:  make([]*perfEventRing, 0, len(rings)),
 		closeFd:     closeFd,
 		pauseFds:    pauseFds,
+		closing:     make(chan struct{}),
 	}
 	if err = pr.Resume(); err != nil {
 		return nil, err
@@ -252,10 +338,55 @@ func NewReaderWithOptions(array *ebpf.Map, perCPUBuffer int, opts ReaderOptions)
 	if err = pr.Resume(); err != nil {
 		return nil, err
 	}
+
+	if opts.Overflow == Drop {
+		pr.overflow = newProfBuf(perCPUBuffer * nCPU)
+		go pr.driveOverflow()
+	}
+
 	runtime.SetFinalizer(pr, (*Reader).Close)
 	return pr, nil
 }
 
+// driveOverflow continuously reads from the epoll-backed rings and
+// copies samples into pr.overflow, so that a fast producer never has to
+// wait on a slow consumer. It exits once the Reader is closed.
+func (pr *Reader) driveOverflow() {
+	for {
+		record, err := pr.readLockedForOverflow()
+		if err != nil {
+			return
+		}
+
+		// profBuf only ever moves raw bytes, so a record that carries no
+		// RawSample of its own -- a kernel lost count or an already-parsed
+		// RequestRead -- has to be re-encoded into a synthetic payload
+		// here, and decoded back by readOverflow, or that information
+		// would simply vanish in Drop mode.
+		switch {
+		case record.RequestRead != nil:
+			pr.overflow.Write(record.CPU, encodeRequestRead(*record.RequestRead))
+		case record.LostSamples > 0:
+			pr.overflow.Write(record.CPU, encodeOverflowLost(record.LostSamples))
+		default:
+			pr.overflow.Write(record.CPU, record.RawSample)
+		}
+	}
+}
+
+// readLockedForOverflow is readLocked, but called from the background
+// drain goroutine rather than from a caller of Read.
+func (pr *Reader) readLockedForOverflow() (Record, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.epollFd == -1 {
+		return Record{}, errClosed
+	}
+
+	return pr.readLocked()
+}
+
 // Close frees resources used by the reader.
 //
 // It interrupts calls to Read.
@@ -267,6 +398,12 @@ func (pr *Reader) Close() error {
 	pr.closeOnce.Do(func() {
 		runtime.SetFinalizer(pr, nil)
 
+		// Wake up a ReadCtx call parked in its netpoll select before
+		// trying to acquire pr.mu below: ReadCtx holds pr.mu for as long
+		// as it's blocked there, so closing this unblocks it in time for
+		// us to actually get the lock instead of deadlocking against it.
+		close(pr.closing)
+
 		// Interrupt Read() via the event fd.
 		var value [8]byte
 		internal.NativeEndian.PutUint64(value[:], 1)
@@ -294,6 +431,11 @@ func (pr *Reader) Close() error {
 		pr.rings = nil
 		pr.pauseFds = nil
 
+		for _, nr := range pr.netpollRings {
+			nr.file.Close()
+		}
+		pr.netpollRings = nil
+
 		pr.array.Close()
 	})
 
@@ -309,6 +451,10 @@ func (pr *Reader) Close() error {
 //
 // Calling Close interrupts the function.
 func (pr *Reader) Read() (Record, error) {
+	if pr.overflow != nil {
+		return pr.readOverflow()
+	}
+
 	pr.mu.Lock()
 	defer pr.mu.Unlock()
 
@@ -316,46 +462,48 @@ func (pr *Reader) Read() (Record, error) {
 		return Record{}, errClosed
 	}
 
-	for {
-		if len(pr.epollRings) == 0 {
-			nEvents, err := unix.EpollWait(pr.epollFd, pr.epollEvents, -1)
-			if temp, ok := err.(temporaryError); ok && temp.Temporary() {
-				// Retry the syscall if we we're interrupted, see https://github.com/golang/go/issues/20400
-				continue
-			}
-
-			if err != nil {
-				return Record{}, err
-			}
-
-			for _, event := range pr.epollEvents[:nEvents] {
-				if int(event.Fd) == pr.closeFd {
-					return Record{}, errClosed
-				}
-
-				ring := pr.rings[cpuForEvent(&event)]
-				pr.epollRings = append(pr.epollRings, ring)
+	return pr.readLocked()
+}
 
-				// Read the current head pointer now, not every time
-				// we read a record. This prevents a single fast producer
-				// from keeping the reader busy.
-				ring.loadHead()
-			}
+// readOverflow busy-polls pr.overflow until a record is available or the
+// Reader is closed. There's no way to block a lock-free reader on a
+// wakeup without reintroducing the contention Drop mode exists to avoid,
+// so callers wanting to block should stick with the default Block mode.
+func (pr *Reader) readOverflow() (Record, error) {
+	for {
+		if record, ok := pr.overflow.Read(); ok {
+			return decodeOverflowRecord(record), nil
 		}
 
-		// Start at the last available event. The order in which we
-		// process them doesn't matter, and starting at the back allows
-		// resizing epollRings to keep track of processed rings.
-		record, err := readRecordFromRing(pr.epollRings[len(pr.epollRings)-1])
-		if err == errEOR {
-			// We've emptied the current ring buffer, process
-			// the next one.
-			pr.epollRings = pr.epollRings[:len(pr.epollRings)-1]
-			continue
+		pr.mu.Lock()
+		closed := pr.epollFd == -1
+		pr.mu.Unlock()
+		if closed {
+			return Record{}, errClosed
 		}
 
-		return record, err
+		runtime.Gosched()
+	}
+}
+
+// decodeOverflowRecord reverses the encoding driveOverflow applies to
+// records that carry no RawSample of their own. record.LostSamples
+// already holds profBuf's own drop count (samples profBuf itself
+// discarded because it was full); a kernel lost count decoded out of the
+// wire payload is added to that, not used to replace it.
+func decodeOverflowRecord(record Record) Record {
+	if rr, ok := parseRequestRead(record.RawSample); ok {
+		record.RawSample = nil
+		record.RequestRead = &rr
+		return record
+	}
+
+	if lost, ok := parseOverflowLost(record.RawSample); ok {
+		record.RawSample = nil
+		record.LostSamples += lost
 	}
+
+	return record
 }
 
 // Pause stops all notifications from this Reader.
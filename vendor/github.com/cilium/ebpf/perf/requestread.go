@@ -0,0 +1,115 @@
+package perf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/internal"
+
+	"github.com/pkg/errors"
+)
+
+// requestReadMagic prefixes a sample that's actually a "please fault this
+// in" request rather than regular event data, so readRecord can tell the
+// two apart without a dedicated perf_event_header type (the kernel has no
+// concept of this protocol -- it's purely a userspace/BPF convention).
+const requestReadMagic uint64 = 0x5245_4144_4649_4e33 // "READFIN3"
+
+// requestReadWire is what a BPF program must lay out via
+// bpf_perf_event_output for ServiceRequestRead to recognise it.
+type requestReadWire struct {
+	Magic uint64
+	PID   uint32
+	_     uint32
+	Addr  uint64
+	Len   uint32
+	_     uint32
+}
+
+const requestReadWireSize = 32
+
+// RequestReadRecord asks userspace to fault in [Addr, Addr+Len) of
+// process PID's memory, because a BPF program's bpf_probe_read_user
+// failed on a page that isn't resident. A BPF program opts a sample into
+// this protocol by writing requestReadMagic as its first 8 bytes,
+// followed by the fields below, instead of its usual payload.
+//
+// CookieMap and CookieKey aren't part of the wire format -- there's no
+// way to carry a *ebpf.Map over bpf_perf_event_output -- so the caller
+// must fill them in, identifying where the BPF program expects its
+// completion cookie, before calling ServiceRequestRead.
+type RequestReadRecord struct {
+	PID  uint32
+	Addr uint64
+	Len  uint32
+
+	CookieMap *ebpf.Map
+	CookieKey uint32
+}
+
+func parseRequestRead(sample []byte) (RequestReadRecord, bool) {
+	if len(sample) != requestReadWireSize {
+		return RequestReadRecord{}, false
+	}
+
+	var wire requestReadWire
+	if err := binary.Read(bytes.NewReader(sample), internal.NativeEndian, &wire); err != nil {
+		return RequestReadRecord{}, false
+	}
+	if wire.Magic != requestReadMagic {
+		return RequestReadRecord{}, false
+	}
+
+	return RequestReadRecord{PID: wire.PID, Addr: wire.Addr, Len: wire.Len}, true
+}
+
+// encodeRequestRead is the inverse of parseRequestRead, used by
+// driveOverflow to push an already-parsed RequestReadRecord back through
+// profBuf's byte-oriented wire so readOverflow can parseRequestRead it
+// again on the way out.
+func encodeRequestRead(r RequestReadRecord) []byte {
+	wire := requestReadWire{Magic: requestReadMagic, PID: r.PID, Addr: r.Addr, Len: r.Len}
+
+	buf := new(bytes.Buffer)
+	buf.Grow(requestReadWireSize)
+	// binary.Write into a bytes.Buffer never errors.
+	_ = binary.Write(buf, internal.NativeEndian, &wire)
+	return buf.Bytes()
+}
+
+// ServiceRequestRead forces [r.Addr, r.Addr+r.Len) of process r.PID's
+// memory to become resident by pread'ing it out of /proc/<pid>/mem, then
+// writes a completion cookie into r.CookieMap at r.CookieKey so the BPF
+// program that emitted the request can be re-driven and retry its
+// bpf_probe_read_user.
+//
+// This gives user-stack unwinders a supported path for faulting in cold
+// pages that bpf_probe_read_user can't reach, instead of every project
+// reinventing the same request/cookie protocol.
+func (pr *Reader) ServiceRequestRead(r RequestReadRecord) error {
+	if r.CookieMap == nil {
+		return errors.New("RequestReadRecord.CookieMap is not set")
+	}
+
+	mem, err := os.Open(fmt.Sprintf("/proc/%d/mem", r.PID))
+	if err != nil {
+		return errors.Wrap(err, "can't open target process memory")
+	}
+	defer mem.Close()
+
+	buf := make([]byte, r.Len)
+	if _, err := mem.ReadAt(buf, int64(r.Addr)); err != nil && err != io.EOF {
+		return errors.Wrap(err, "can't fault in target range")
+	}
+
+	const done uint32 = 1
+	if err := r.CookieMap.Put(r.CookieKey, done); err != nil {
+		return errors.Wrap(err, "can't write completion cookie")
+	}
+
+	return nil
+}
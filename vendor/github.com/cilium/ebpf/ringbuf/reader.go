@@ -0,0 +1,234 @@
+package ringbuf
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/internal"
+	"github.com/cilium/ebpf/internal/unix"
+
+	"github.com/pkg/errors"
+)
+
+var errClosed = errors.New("ringbuf reader was closed")
+
+// Reader allows reading bpf_ringbuf_output (or bpf_ringbuf_reserve plus
+// bpf_ringbuf_submit) records from a BPF_MAP_TYPE_RINGBUF map.
+//
+// A BPF_MAP_TYPE_RINGBUF is a single ring shared by every CPU, so unlike
+// perf.Reader there's only ever one ring to poll, and no Record.CPU field.
+type Reader struct {
+	// mu protects read/write access to the Reader structure with the
+	// exception of 'paused', which is protected by 'pauseMu'.
+	mu sync.Mutex
+
+	ringbufMap *ebpf.Map
+	ring       *ringbufEventRing
+
+	epollFd     int
+	epollEvents []unix.EpollEvent
+	// Eventfd for closing
+	closeFd   int
+	closeOnce sync.Once
+
+	// paused is protected by pauseMu so Pause/Resume can run independently
+	// of an ongoing Read call.
+	pauseMu sync.Mutex
+	paused  bool
+}
+
+// NewReader creates a new reader.
+//
+// ringbufMap must be a BPF_MAP_TYPE_RINGBUF. size gives the size of the
+// ring buffer in bytes, which must match the size the map was created
+// with; Go can't resize a live ring buffer map.
+func NewReader(ringbufMap *ebpf.Map, size int) (pr *Reader, err error) {
+	if size < 1 {
+		return nil, errors.New("size must be larger than 0")
+	}
+
+	epollFd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create epoll fd")
+	}
+
+	fds := []int{epollFd}
+	defer func() {
+		if err != nil {
+			for _, fd := range fds {
+				unix.Close(fd)
+			}
+		}
+	}()
+
+	ringbufMap, err = ringbufMap.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	ring, err := newRingbufEventRing(ringbufMap.FD(), size)
+	if err != nil {
+		ringbufMap.Close()
+		return nil, errors.Wrap(err, "failed to create ringbuf ring")
+	}
+
+	if err := addToEpoll(epollFd, ring.fd); err != nil {
+		return nil, err
+	}
+
+	closeFd, err := unix.Eventfd(0, unix.O_CLOEXEC|unix.O_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	fds = append(fds, closeFd)
+
+	if err := addToEpoll(epollFd, closeFd); err != nil {
+		return nil, err
+	}
+
+	pr = &Reader{
+		ringbufMap:  ringbufMap,
+		ring:        ring,
+		epollFd:     epollFd,
+		epollEvents: make([]unix.EpollEvent, 2),
+		closeFd:     closeFd,
+	}
+	runtime.SetFinalizer(pr, (*Reader).Close)
+	return pr, nil
+}
+
+func addToEpoll(epollFd, fd int) error {
+	event := unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(fd),
+	}
+	return errors.Wrap(unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, fd, &event), "can't add fd to epoll")
+}
+
+// Close frees resources used by the reader.
+//
+// It interrupts calls to Read.
+func (pr *Reader) Close() error {
+	var err error
+	pr.closeOnce.Do(func() {
+		runtime.SetFinalizer(pr, nil)
+
+		// Interrupt Read() via the event fd.
+		var value [8]byte
+		internal.NativeEndian.PutUint64(value[:], 1)
+		if _, err = unix.Write(pr.closeFd, value[:]); err != nil {
+			err = errors.Wrap(err, "can't write event fd")
+			return
+		}
+
+		// Acquire the locks. This ensures that Read, Pause and Resume
+		// aren't running.
+		pr.mu.Lock()
+		defer pr.mu.Unlock()
+		pr.pauseMu.Lock()
+		defer pr.pauseMu.Unlock()
+
+		unix.Close(pr.epollFd)
+		unix.Close(pr.closeFd)
+		pr.epollFd, pr.closeFd = -1, -1
+
+		pr.ring.Close()
+		pr.ring = nil
+
+		pr.ringbufMap.Close()
+	})
+
+	return errors.Wrap(err, "close ringbuf reader")
+}
+
+// Read the next record from the ring buffer.
+//
+// The function blocks until there is at least one record to read, or
+// until Close interrupts it.
+func (pr *Reader) Read() (Record, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.epollFd == -1 {
+		return Record{}, errClosed
+	}
+
+	for {
+		record, err := pr.ring.readRecord()
+		if err == errDiscard {
+			continue
+		}
+		if err != errEOR {
+			return record, err
+		}
+
+		nEvents, err := unix.EpollWait(pr.epollFd, pr.epollEvents, -1)
+		if temp, ok := err.(temporaryError); ok && temp.Temporary() {
+			// Retry the syscall if we were interrupted, see
+			// https://github.com/golang/go/issues/20400
+			continue
+		}
+
+		if err != nil {
+			return Record{}, err
+		}
+
+		for _, event := range pr.epollEvents[:nEvents] {
+			if int(event.Fd) == pr.closeFd {
+				return Record{}, errClosed
+			}
+		}
+	}
+}
+
+// Pause stops all notifications from this Reader.
+//
+// While the Reader is paused, the BPF program can still reserve and
+// submit records, but Read will not be woken up until a call to Resume.
+func (pr *Reader) Pause() error {
+	pr.pauseMu.Lock()
+	defer pr.pauseMu.Unlock()
+
+	if pr.epollFd == -1 {
+		return errClosed
+	}
+	if pr.paused {
+		return nil
+	}
+
+	if err := unix.EpollCtl(pr.epollFd, unix.EPOLL_CTL_DEL, pr.ring.fd, nil); err != nil {
+		return errors.Wrap(err, "can't remove ring fd from epoll")
+	}
+	pr.paused = true
+	return nil
+}
+
+// Resume allows this reader to emit notifications again.
+func (pr *Reader) Resume() error {
+	pr.pauseMu.Lock()
+	defer pr.pauseMu.Unlock()
+
+	if pr.epollFd == -1 {
+		return errClosed
+	}
+	if !pr.paused {
+		return nil
+	}
+
+	if err := addToEpoll(pr.epollFd, pr.ring.fd); err != nil {
+		return err
+	}
+	pr.paused = false
+	return nil
+}
+
+type temporaryError interface {
+	Temporary() bool
+}
+
+// IsClosed returns true if the error occurred because a Reader was
+// closed.
+func IsClosed(err error) bool {
+	return errors.Cause(err) == errClosed
+}
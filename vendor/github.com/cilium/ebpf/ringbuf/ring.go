@@ -0,0 +1,151 @@
+package ringbuf
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/cilium/ebpf/internal"
+	"github.com/cilium/ebpf/internal/unix"
+
+	"github.com/pkg/errors"
+)
+
+var errEOR = errors.New("end of ring")
+var errDiscard = errors.New("discarded record")
+
+// ringbufHeader is the 8 byte header the kernel writes in front of every
+// sample or discarded reservation in a BPF_MAP_TYPE_RINGBUF. The low 30
+// bits of Len carry the record's length; the top two bits mark whether
+// the producer is still writing it (busy) or whether it was discarded
+// and should be skipped without being delivered (discard).
+type ringbufHeader struct {
+	Len uint32
+	_   uint32 // reserved by the kernel, currently always zero
+}
+
+const ringbufHeaderSize = 8
+
+const (
+	ringbufBusyBit    = uint32(1) << 31
+	ringbufDiscardBit = uint32(1) << 30
+	ringbufLenMask    = ringbufBusyBit | ringbufDiscardBit
+)
+
+// Record contains the raw sample submitted via bpf_ringbuf_output, or via
+// bpf_ringbuf_reserve followed by bpf_ringbuf_submit.
+//
+// Unlike perf.Record there is no CPU field: a BPF_MAP_TYPE_RINGBUF is a
+// single MPSC ring shared by every CPU, not one ring per CPU.
+type Record struct {
+	// RawSample is the data submitted from the BPF program. It is not
+	// padded for alignment the way perf samples are.
+	RawSample []byte
+}
+
+// ringbufEventRing wraps the two mmaps the kernel sets up for a
+// BPF_MAP_TYPE_RINGBUF: a single read-write page holding the consumer
+// position, and a read-only mapping of the producer position followed by
+// the data area, doubled back to back so that a record is never split by
+// wraparound.
+type ringbufEventRing struct {
+	fd int
+
+	// cons is the only memory userspace is allowed to write to: advancing
+	// it tells the kernel how much space it can reclaim for new samples.
+	cons []byte
+	// prod covers the producer position (at offset 0) and the data pages
+	// (at offset pageSize), mapped a second time immediately afterwards.
+	prod []byte
+
+	pageSize int
+	mask     uint64
+
+	// read is the byte position of the next unread record, relative to
+	// the start of the (non-doubled) data area. It only ever increases.
+	read uint64
+}
+
+func newRingbufEventRing(fd, size int) (*ringbufEventRing, error) {
+	pageSize := unix.Getpagesize()
+
+	cons, err := unix.Mmap(fd, 0, pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't mmap consumer page")
+	}
+
+	prod, err := unix.Mmap(fd, int64(pageSize), pageSize+2*size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		unix.Munmap(cons)
+		return nil, errors.Wrap(err, "can't mmap producer and data pages")
+	}
+
+	return &ringbufEventRing{
+		fd:       fd,
+		cons:     cons,
+		prod:     prod,
+		pageSize: pageSize,
+		mask:     uint64(size) - 1,
+	}, nil
+}
+
+// Close unmaps the ring. It doesn't close the underlying fd, which is
+// owned by the Reader.
+func (ring *ringbufEventRing) Close() {
+	unix.Munmap(ring.prod)
+	unix.Munmap(ring.cons)
+	ring.prod, ring.cons = nil, nil
+}
+
+func (ring *ringbufEventRing) loadProducerPos() uint64 {
+	// Acquire semantics: pairs with the kernel's release store when it
+	// publishes a new producer position, so that the header and payload
+	// bytes we're about to read are guaranteed visible.
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&ring.prod[0])))
+}
+
+func (ring *ringbufEventRing) storeConsumerPos() {
+	// Release semantics: pairs with the kernel's acquire load of the
+	// consumer position before it reuses the space we just freed.
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&ring.cons[0])), ring.read)
+}
+
+func (ring *ringbufEventRing) dataAt(pos uint64, n int) []byte {
+	off := pos & ring.mask
+	return ring.prod[uint64(ring.pageSize)+off : uint64(ring.pageSize)+off+uint64(n)]
+}
+
+// readRecord parses the next record out of the ring, if any.
+//
+// It returns errEOR once the consumer has caught up with the producer,
+// and errDiscard for a reservation the BPF program discarded, which
+// carries no payload and should simply be skipped.
+func (ring *ringbufEventRing) readRecord() (Record, error) {
+	prodPos := ring.loadProducerPos()
+	if ring.read >= prodPos {
+		return Record{}, errEOR
+	}
+
+	rawHeader := internal.NativeEndian.Uint32(ring.dataAt(ring.read, ringbufHeaderSize))
+	if rawHeader&ringbufBusyBit != 0 {
+		// The producer has reserved this space but hasn't committed it
+		// yet; stop here and pick it up on a future call.
+		return Record{}, errEOR
+	}
+
+	length := rawHeader &^ ringbufLenMask
+	sampleOff := ring.read + ringbufHeaderSize
+	ring.read = sampleOff + alignUp(uint64(length), 8)
+	ring.storeConsumerPos()
+
+	if rawHeader&ringbufDiscardBit != 0 {
+		return Record{}, errDiscard
+	}
+
+	sample := make([]byte, length)
+	copy(sample, ring.dataAt(sampleOff, int(length)))
+	return Record{RawSample: sample}, nil
+}
+
+func alignUp(n, alignment uint64) uint64 {
+	return (n + alignment - 1) &^ (alignment - 1)
+}